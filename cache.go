@@ -0,0 +1,102 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+    "time"
+)
+
+// cachedPackageFile mirrors the information addDeb would otherwise have to
+// re-derive by re-reading the .deb's archive and re-hashing it on every run.
+// It is keyed (in repoCache.Packages) by "<component>/<arch>/<basename>" so
+// entries survive being re-read across invocations regardless of working
+// directory.
+type cachedPackageFile struct {
+    Path     string    `json:"path"`
+    Size     int64     `json:"size"`
+    ModTime  time.Time `json:"mod_time"`
+    PkgName  string    `json:"pkg_name"`
+    Arch     string    `json:"arch"`
+    Control  string    `json:"control"`
+    Contents []string  `json:"contents"`
+    MD5      string    `json:"md5"`
+    SHA1     string    `json:"sha1"`
+    SHA256   string    `json:"sha256"`
+    SHA512   string    `json:"sha512"`
+}
+
+// repoCache is the on-disk cache for a single distribution, stored at
+// dists/<dist>/.repo-cache.json. It lets re-runs over an input directory
+// skip re-hashing and re-extracting .deb files that have not changed.
+type repoCache struct {
+    Packages map[string]cachedPackageFile `json:"packages"`
+}
+
+func cacheFilePath(distributionPath string) string {
+    return filepath.Join(distributionPath, ".repo-cache.json")
+}
+
+func loadRepoCache(distributionPath string) *repoCache {
+    c := &repoCache{Packages: map[string]cachedPackageFile{}}
+
+    data, err := os.ReadFile(cacheFilePath(distributionPath))
+    if err != nil {
+        return c
+    }
+    if err := json.Unmarshal(data, c); err != nil {
+        fmt.Fprintf(os.Stderr, "Warning: ignoring corrupt repo cache: %v\n", err)
+        return &repoCache{Packages: map[string]cachedPackageFile{}}
+    }
+    if c.Packages == nil {
+        c.Packages = map[string]cachedPackageFile{}
+    }
+    return c
+}
+
+func (c *repoCache) save(distributionPath string) error {
+    data, err := json.MarshalIndent(c, "", "  ")
+    if err != nil {
+        return err
+    }
+    return os.WriteFile(cacheFilePath(distributionPath), data, 0644)
+}
+
+func cacheKey(component, arch, basename string) string {
+    return component + "/" + arch + "/" + basename
+}
+
+// lookup returns the cached entry for key if it still matches the file at
+// path (same size and modification time), so its control data, contents
+// listing and hashes can be reused as-is.
+func (c *repoCache) lookup(key, path string) (cachedPackageFile, bool) {
+    entry, ok := c.Packages[key]
+    if !ok {
+        return cachedPackageFile{}, false
+    }
+    fi, err := os.Stat(path)
+    if err != nil {
+        return cachedPackageFile{}, false
+    }
+    if entry.Size != fi.Size() || !entry.ModTime.Equal(fi.ModTime()) {
+        return cachedPackageFile{}, false
+    }
+    return entry, true
+}
+
+func (c *repoCache) put(key string, entry cachedPackageFile) {
+    c.Packages[key] = entry
+}
+
+// get returns the cache entry for key without re-validating it against disk.
+// It is meant to be used later in the same run, after addDeb has already
+// established (via lookup) that the entry is current.
+func (c *repoCache) get(key string) (cachedPackageFile, bool) {
+    entry, ok := c.Packages[key]
+    return entry, ok
+}
+
+func (c *repoCache) remove(key string) {
+    delete(c.Packages, key)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+    "archive/tar"
+    "compress/bzip2"
+    "compress/gzip"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "os"
+    "strings"
+
+    "github.com/blakesmith/ar"
+    "github.com/klauspost/compress/zstd"
+    "github.com/ulikunitz/xz"
+)
+
+// inspectDeb reads a .deb's outer ar archive once and returns the contents
+// of its control file together with the paths of every non-directory entry
+// (files, symlinks, ...) in its data archive,
+// replacing the old ar/tar subprocess pipeline. It understands
+// control.tar.{gz,xz,zst} and data.tar.{gz,xz,zst,bz2}, which covers the
+// compressions newer dpkg-deb versions (including zstd, the current
+// default) actually produce.
+func inspectDeb(debfile string) (control string, files []string, err error) {
+    f, err := os.Open(debfile)
+    if err != nil {
+        return "", nil, err
+    }
+    defer f.Close()
+
+    arReader := ar.NewReader(f)
+    for {
+        hdr, err := arReader.Next()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return "", nil, fmt.Errorf("reading ar archive: %w", err)
+        }
+
+        name := strings.TrimSpace(hdr.Name)
+        switch {
+        case strings.HasPrefix(name, "control.tar"):
+            control, err = readControlMember(name, arReader)
+            if err != nil {
+                return "", nil, fmt.Errorf("reading %s: %w", name, err)
+            }
+        case strings.HasPrefix(name, "data.tar"):
+            files, err = listDataMember(name, arReader)
+            if err != nil {
+                return "", nil, fmt.Errorf("reading %s: %w", name, err)
+            }
+        }
+    }
+
+    if control == "" {
+        return "", nil, fmt.Errorf("no control.tar.* member found")
+    }
+    return control, files, nil
+}
+
+// decompressMember wraps r according to the compression implied by an ar
+// member's name (control.tar.gz, data.tar.zst, ...) and returns a cleanup
+// function that must be called once the caller is done reading.
+func decompressMember(name string, r io.Reader) (io.Reader, func(), error) {
+    noop := func() {}
+    switch {
+    case strings.HasSuffix(name, ".tar"):
+        return r, noop, nil
+    case strings.HasSuffix(name, ".tar.gz"):
+        gz, err := gzip.NewReader(r)
+        if err != nil {
+            return nil, noop, err
+        }
+        return gz, func() { gz.Close() }, nil
+    case strings.HasSuffix(name, ".tar.xz"):
+        xr, err := xz.NewReader(r)
+        if err != nil {
+            return nil, noop, err
+        }
+        return xr, noop, nil
+    case strings.HasSuffix(name, ".tar.zst"):
+        zr, err := zstd.NewReader(r)
+        if err != nil {
+            return nil, noop, err
+        }
+        return zr, func() { zr.Close() }, nil
+    case strings.HasSuffix(name, ".tar.bz2"):
+        return bzip2.NewReader(r), noop, nil
+    }
+    return nil, noop, fmt.Errorf("unsupported compression")
+}
+
+func readControlMember(name string, r io.Reader) (string, error) {
+    tarSrc, closer, err := decompressMember(name, r)
+    if err != nil {
+        return "", err
+    }
+    defer closer()
+
+    tr := tar.NewReader(tarSrc)
+    for {
+        hdr, err := tr.Next()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return "", err
+        }
+        if strings.TrimPrefix(hdr.Name, "./") == "control" {
+            data, err := ioutil.ReadAll(tr)
+            // Trim the trailing newline dpkg-deb writes after the last
+            // control field so callers appending "\nFilename: ..." etc.
+            // produce one Packages stanza instead of two split by a blank
+            // line.
+            return strings.TrimRight(string(data), "\n"), err
+        }
+    }
+    return "", fmt.Errorf("control member has no ./control entry")
+}
+
+func listDataMember(name string, r io.Reader) ([]string, error) {
+    tarSrc, closer, err := decompressMember(name, r)
+    if err != nil {
+        return nil, err
+    }
+    defer closer()
+
+    var files []string
+    tr := tar.NewReader(tarSrc)
+    for {
+        hdr, err := tr.Next()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return nil, err
+        }
+        if hdr.Typeflag == tar.TypeDir {
+            continue
+        }
+        files = append(files, strings.TrimPrefix(hdr.Name, "./"))
+    }
+    return files, nil
+}
@@ -1,23 +1,17 @@
 package main
 
 import (
-//    "compress/gzip"
-    "crypto/md5"
-    "crypto/sha1"
-    "crypto/sha256"
-    "crypto/sha512"
     "flag"
     "fmt"
     "github.com/ulikunitz/xz"
-    "hash"
     "io"
     "io/ioutil"
     "os"
-    "os/exec"
     "path/filepath"
     "regexp"
     "sort"
     "strings"
+    "sync"
     "time"
 )
 
@@ -33,6 +27,12 @@ var (
     useHardLinks      bool
     signRepo          bool
     distributionPath  string
+    keepVersions      int
+    signingKeyPath    string
+    signingKeyPassphraseFile string
+    serveAddr         string
+    serveUploadSecret string
+    versionFlag       *bool
 )
 
 func init() {
@@ -42,78 +42,64 @@ func init() {
     flag.StringVar(&defaultComponent, "component", "extras", "name of component folder")
     flag.BoolVar(&useHardLinks, "use-hard-links", false, "use hard links instead of copying deb files")
     flag.BoolVar(&signRepo, "sign", false, "sign repo with GPG key")
+    flag.StringVar(&signingKeyPath, "signing-key", "", "path to an armored GPG secret key to sign the repo with")
+    flag.StringVar(&signingKeyPassphraseFile, "signing-key-passphrase-file", "", "path to a file containing the signing key's passphrase")
+    flag.IntVar(&keepVersions, "keep-versions", 0, "keep only the N newest versions of each package/arch in pool/ (0 keeps all)")
+    flag.StringVar(&mirrorURL, "mirror", "", "base URL of an upstream apt repo to pull .deb files from")
+    flag.StringVar(&mirrorSuite, "mirror-suite", "stable", "suite/distribution to mirror from")
+    flag.StringVar(&mirrorComponent, "mirror-component", "main", "component to mirror from")
+    flag.StringVar(&mirrorArch, "mirror-arch", "aarch64", "architecture to mirror")
+    flag.StringVar(&mirrorPackages, "mirror-packages", "", "comma-separated list of package names to mirror")
+    flag.StringVar(&mirrorKeyring, "mirror-keyring", "", "path to an armored GPG keyring to verify the upstream Release file against")
+    flag.BoolVar(&mirrorResolveDeps, "mirror-resolve-deps", false, "also mirror the Depends closure of -mirror-packages")
+    flag.StringVar(&serveAddr, "serve", "", "keep running and serve outputPath over HTTP on this address (e.g. :8080)")
+    flag.StringVar(&serveUploadSecret, "serve-upload-secret", "", "shared secret required (as X-Repo-Secret) to use the upload endpoint; upload is disabled if empty")
+    flag.IntVar(&jobs, "jobs", 0, "number of parallel workers for hashing and xz compression (0 = runtime.NumCPU())")
     flag.Usage = func() {
         fmt.Fprintf(os.Stderr, "Usage: %s [options]\n", os.Args[0])
         flag.PrintDefaults()
     }
-    versionFlag := flag.Bool("version", false, "Display version information")
-    flag.Parse()
-    if *versionFlag {
-        fmt.Println("termux-apt-builder v1.0\nby PhateValleyman\nJonas.Ned@outlook.com")
-        os.Exit(0)
-    }
+    versionFlag = flag.Bool("version", false, "Display version information")
 }
 
 func getPackageName(filename string) string {
     return strings.Split(filename, "_")[0]
 }
 
-func runShellCommand(cmd string) (string, error) {
-    out, err := exec.Command("sh", "-c", cmd).Output()
-    if err != nil {
-        return "", err
-    }
-    return string(out), nil
-}
-
+// controlFileContents is a thin wrapper around inspectDeb for the one call
+// site that only needs the control text: the Packages-generation pass in
+// buildRepo, which already has cached control text on the common path and only
+// falls back to this on a cache miss.
 func controlFileContents(debfile string) string {
-    fileList, err := runShellCommand(fmt.Sprintf("ar t %s", debfile))
-    if err != nil {
-        fmt.Fprintf(os.Stderr, "Error listing contents of '%s'\n", debfile)
-        os.Exit(1)
-    }
-
-    var controlFilename, tarArgs string
-    if strings.Contains(fileList, "control.tar.gz") {
-        controlFilename = "control.tar.gz"
-        tarArgs = "-z"
-    } else if strings.Contains(fileList, "control.tar.xz") {
-        controlFilename = "control.tar.xz"
-        tarArgs = "-J"
-    } else {
-        fmt.Fprintf(os.Stderr, "Failed to find control file in '%s'\n", debfile)
-        os.Exit(1)
-    }
-
-    cmd := fmt.Sprintf("ar p %s %s | tar -O %s -xf - ./control", debfile, controlFilename, tarArgs)
-    contents, err := runShellCommand(cmd)
+    control, _, err := inspectDeb(debfile)
     if err != nil {
-        fmt.Fprintf(os.Stderr, "Error extracting control file from '%s'\n", debfile)
+        fmt.Fprintf(os.Stderr, "Error reading control file from '%s': %v\n", debfile, err)
         os.Exit(1)
     }
-
-    return contents
+    return control
 }
 
-func listPackageFiles(debfile string) []string {
-    allContent, err := runShellCommand(fmt.Sprintf("ar p %s data.tar.xz | tar -tJ", debfile))
-    if err != nil {
-        fmt.Fprintf(os.Stderr, "Error listing package files for '%s'\n", debfile)
-        os.Exit(1)
-    }
-    var files []string
-    for _, file := range strings.Split(allContent, "\n") {
-        if len(file) > 0 && file[len(file)-1] != '/' {
-            files = append(files, strings.TrimPrefix(file, "./"))
+func addDeb(debToAddPath, component string, useHardLinks bool, cache *repoCache) {
+    key := cacheKey(component, archFromDebFilename(filepath.Base(debToAddPath)), filepath.Base(debToAddPath))
+    cached, cacheHit := cache.lookup(key, debToAddPath)
+
+    var debToAddControlFile, debToAddPkgName, debArch string
+    var packageFiles []string
+    if cacheHit {
+        debToAddControlFile = cached.Control
+        debToAddPkgName = cached.PkgName
+        debArch = cached.Arch
+        packageFiles = cached.Contents
+    } else {
+        var err error
+        debToAddControlFile, packageFiles, err = inspectDeb(debToAddPath)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "Error inspecting '%s': %v\n", debToAddPath, err)
+            os.Exit(1)
         }
+        debToAddPkgName = regexp.MustCompile(`Package: (.*)`).FindStringSubmatch(debToAddControlFile)[1]
+        debArch = regexp.MustCompile(`Architecture: (.*)`).FindStringSubmatch(debToAddControlFile)[1]
     }
-    return files
-}
-
-func addDeb(debToAddPath, component string, useHardLinks bool) {
-    debToAddControlFile := controlFileContents(debToAddPath)
-    debToAddPkgName := regexp.MustCompile(`Package: (.*)`).FindStringSubmatch(debToAddControlFile)[1]
-    debArch := regexp.MustCompile(`Architecture: (.*)`).FindStringSubmatch(debToAddControlFile)[1]
 
     if !contains(supportedArches, debArch) {
         fmt.Fprintf(os.Stderr, "Unsupported arch '%s' in '%s'\n", debArch, filepath.Base(debToAddPath))
@@ -122,19 +108,24 @@ func addDeb(debToAddPath, component string, useHardLinks bool) {
     encounteredArches[debArch] = true
 
     archDirPath := filepath.Join(distributionPath, component, "binary-"+debArch)
-
     if _, err := os.Stat(archDirPath); os.IsNotExist(err) {
         os.MkdirAll(archDirPath, 0755)
     }
 
-    fmt.Println("Adding deb file:", filepath.Base(debToAddPath))
-    destDebDirPath := filepath.Join(distributionPath, component, "binary-"+debArch)
-    if _, err := os.Stat(destDebDirPath); os.IsNotExist(err) {
-        os.MkdirAll(destDebDirPath, 0755)
+    destinationDebFile := poolDebPath(outputPath, component, debToAddPkgName, filepath.Base(debToAddPath))
+    if err := os.MkdirAll(filepath.Dir(destinationDebFile), 0755); err != nil {
+        fmt.Fprintf(os.Stderr, "Error creating pool directory for '%s'\n", debToAddPath)
+        os.Exit(1)
+    }
+
+    if cacheHit {
+        fmt.Println("Reusing cached metadata for:", filepath.Base(debToAddPath))
+    } else {
+        fmt.Println("Adding deb file:", filepath.Base(debToAddPath))
     }
-    destinationDebFile := filepath.Join(destDebDirPath, filepath.Base(debToAddPath))
 
     if useHardLinks {
+        os.Remove(destinationDebFile)
         os.Link(debToAddPath, destinationDebFile)
     } else {
         if err := copyFile(debToAddPath, destinationDebFile); err != nil {
@@ -150,9 +141,33 @@ func addDeb(debToAddPath, component string, useHardLinks bool) {
     }
     defer contentsFile.Close()
 
-    for _, f := range listPackageFiles(destinationDebFile) {
+    for _, f := range packageFiles {
         fmt.Fprintf(contentsFile, "%-80s %s\n", f, debToAddPkgName)
     }
+
+    if cacheHit {
+        return
+    }
+
+    fi, err := os.Stat(debToAddPath)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Error stat'ing '%s'\n", debToAddPath)
+        os.Exit(1)
+    }
+    debHashes := hashAllFile(destinationDebFile)
+    cache.put(key, cachedPackageFile{
+        Path:     debToAddPath,
+        Size:     fi.Size(),
+        ModTime:  fi.ModTime(),
+        PkgName:  debToAddPkgName,
+        Arch:     debArch,
+        Control:  debToAddControlFile,
+        Contents: packageFiles,
+        MD5:      debHashes.MD5,
+        SHA1:     debHashes.SHA1,
+        SHA256:   debHashes.SHA256,
+        SHA512:   debHashes.SHA512,
+    })
 }
 
 func copyFile(src, dst string) error {
@@ -187,11 +202,30 @@ func contains(slice []string, item string) bool {
 func main() {
     flag.Parse()
 
+    if *versionFlag {
+        fmt.Println("termux-apt-builder v1.0\nby PhateValleyman\nJonas.Ned@outlook.com")
+        os.Exit(0)
+    }
+
     if inputPath == "" || outputPath == "" {
         flag.Usage()
         os.Exit(1)
     }
 
+    buildRepo()
+
+    if serveAddr != "" {
+        serveRepo()
+    }
+}
+
+// buildRepo performs a full build of the repository tree: it reads every
+// .deb under inputPath (and anything mirrored via -mirror), (re)writes the
+// pool, Packages/Contents files and a Release, and signs it if requested.
+// It is also what -serve calls after an upload to re-index the repo.
+func buildRepo() {
+    COMPONENTS = nil
+    encounteredArches = map[string]bool{}
     distributionPath = filepath.Join(outputPath, "dists", distribution)
 
     if _, err := os.Stat(inputPath); os.IsNotExist(err) {
@@ -211,11 +245,14 @@ func main() {
     }
     debsInPath = append(debsInPath, debsInSubPath...)
 
-    if len(debsInPath) == 0 {
+    if len(debsInPath) == 0 && mirrorURL == "" {
         fmt.Fprintf(os.Stderr, "No .deb file found in '%s'\n", inputPath)
         os.Exit(1)
     }
 
+    os.MkdirAll(distributionPath, 0755)
+    cache := loadRepoCache(distributionPath)
+
     for _, debPath := range debsInPath {
         component := filepath.Dir(strings.TrimPrefix(debPath, inputPath))
         if component == "." {
@@ -227,7 +264,30 @@ func main() {
                 os.RemoveAll(filepath.Join(distributionPath, component))
             }
         }
-        addDeb(debPath, component, useHardLinks)
+        addDeb(debPath, component, useHardLinks, cache)
+    }
+
+    if mirrorURL != "" {
+        mirroredDebs, err := runMirror(outputPath)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "Error mirroring from '%s': %v\n", mirrorURL, err)
+            os.Exit(1)
+        }
+        if !contains(COMPONENTS, mirrorComponent) {
+            COMPONENTS = append(COMPONENTS, mirrorComponent)
+            if _, err := os.Stat(filepath.Join(distributionPath, mirrorComponent)); err == nil {
+                os.RemoveAll(filepath.Join(distributionPath, mirrorComponent))
+            }
+        }
+        for _, debPath := range mirroredDebs {
+            addDeb(debPath, mirrorComponent, useHardLinks, cache)
+        }
+    }
+
+    pruneOldVersions(cache, keepVersions)
+
+    if err := cache.save(distributionPath); err != nil {
+        fmt.Fprintf(os.Stderr, "Warning: failed to save repo cache: %v\n", err)
     }
 
     releaseFilePath := filepath.Join(distributionPath, "Release")
@@ -245,13 +305,14 @@ func main() {
     fmt.Fprintln(releaseFile, "Suite:", distribution)
     fmt.Fprintln(releaseFile, "Date:", time.Now().UTC().Format(time.RFC1123))
 
+    var xzJobs []string // pairs of "input\x00output" to compress concurrently
+
     for _, component := range COMPONENTS {
         for _, archDirPath := range glob(filepath.Join(distributionPath, component, "binary-*")) {
             arch := strings.Split(filepath.Base(archDirPath), "-")[1]
             fmt.Println("Creating package file for", component, "and", arch)
             packagesFilePath := filepath.Join(archDirPath, "Packages")
             packagesxzFilePath := packagesFilePath + ".xz"
-            binaryPath := "binary-" + arch
 
             packagesFile, err := os.Create(packagesFilePath)
             if err != nil {
@@ -259,19 +320,31 @@ func main() {
                 os.Exit(1)
             }
 
-            for _, debToReadPath := range glob(filepath.Join(archDirPath, "*.deb")) {
-                scanpackagesOutput := controlFileContents(debToReadPath)
-                scanpackagesOutput += "\nFilename: " + filepath.Join("dists", distribution, component, binaryPath, filepath.Base(debToReadPath))
-                scanpackagesOutput += "\nSize: " + fmt.Sprint(fileSize(debToReadPath))
-
-                for _, hashType := range hashes {
-                    var hashString string
-                    if hashType == "md5" {
-                        hashString = "MD5Sum"
-                    } else {
-                        hashString = strings.ToUpper(hashType)
-                    }
-                    scanpackagesOutput += fmt.Sprintf("\n%s: %x", hashString, hashFile(hashType, debToReadPath))
+            for _, debToReadPath := range poolDebsForArch(outputPath, component, arch) {
+                filename, err := filepath.Rel(outputPath, debToReadPath)
+                if err != nil {
+                    filename = debToReadPath
+                }
+
+                var scanpackagesOutput string
+                if cached, ok := cache.get(cacheKey(component, arch, filepath.Base(debToReadPath))); ok {
+                    scanpackagesOutput = cached.Control
+                    scanpackagesOutput += "\nFilename: " + filename
+                    scanpackagesOutput += "\nSize: " + fmt.Sprint(fileSize(debToReadPath))
+                    scanpackagesOutput += "\nMD5Sum: " + cached.MD5
+                    scanpackagesOutput += "\nSHA1: " + cached.SHA1
+                    scanpackagesOutput += "\nSHA256: " + cached.SHA256
+                    scanpackagesOutput += "\nSHA512: " + cached.SHA512
+                } else {
+                    scanpackagesOutput = controlFileContents(debToReadPath)
+                    scanpackagesOutput += "\nFilename: " + filename
+                    scanpackagesOutput += "\nSize: " + fmt.Sprint(fileSize(debToReadPath))
+
+                    debHashes := hashAllFile(debToReadPath)
+                    scanpackagesOutput += "\nMD5Sum: " + debHashes.MD5
+                    scanpackagesOutput += "\nSHA1: " + debHashes.SHA1
+                    scanpackagesOutput += "\nSHA256: " + debHashes.SHA256
+                    scanpackagesOutput += "\nSHA512: " + debHashes.SHA512
                 }
 
                 fmt.Fprintln(packagesFile, scanpackagesOutput)
@@ -279,17 +352,41 @@ func main() {
             }
 
             packagesFile.Close()
-            compressXz(packagesFilePath, packagesxzFilePath)
+            xzJobs = append(xzJobs, packagesFilePath+"\x00"+packagesxzFilePath)
         }
 
         for _, contentsFile := range glob(filepath.Join(distributionPath, component, "Contents-*")) {
-            compressXz(contentsFile, contentsFile+".xz")
+            xzJobs = append(xzJobs, contentsFile+"\x00"+contentsFile+".xz")
         }
     }
 
+    parallelForEach(xzJobs, func(job string) {
+        parts := strings.SplitN(job, "\x00", 2)
+        compressXz(parts[0], parts[1])
+    })
+
     COMPONENTS = filterDirs(distributionPath)
     fmt.Fprintln(releaseFile, "Components:", strings.Join(COMPONENTS, " "))
 
+    var releaseFilePaths []string
+    for _, component := range COMPONENTS {
+        for _, archDirPath := range glob(filepath.Join(distributionPath, component, "binary-*")) {
+            for _, f := range []string{"Packages", "Packages.xz"} {
+                releaseFilePaths = append(releaseFilePaths, filepath.Join(archDirPath, f))
+            }
+        }
+        releaseFilePaths = append(releaseFilePaths, glob(filepath.Join(distributionPath, component, "Contents-*"))...)
+    }
+
+    releaseHashes := map[string]fileHashes{}
+    var releaseHashesMu sync.Mutex
+    parallelForEach(releaseFilePaths, func(path string) {
+        h := hashAllFile(path)
+        releaseHashesMu.Lock()
+        releaseHashes[path] = h
+        releaseHashesMu.Unlock()
+    })
+
     for _, hashType := range hashes {
         var hashString string
         if hashType == "md5" {
@@ -303,14 +400,14 @@ func main() {
                 for _, f := range []string{"Packages", "Packages.xz"} {
                     filePath := filepath.Join(archDirPath, f)
                     fmt.Fprintf(releaseFile, " %s %d %s\n",
-                        hashFile(hashType, filePath),
+                        releaseHashes[filePath].forType(hashType),
                         fileSize(filePath),
                         filepath.Join(component, filepath.Base(archDirPath), f))
                 }
             }
             for _, contentsFile := range glob(filepath.Join(distributionPath, component, "Contents-*")) {
                 fmt.Fprintf(releaseFile, " %s %d %s\n",
-                    hashFile(hashType, contentsFile),
+                    releaseHashes[contentsFile].forType(hashType),
                     fileSize(contentsFile),
                     contentsFile)
             }
@@ -318,9 +415,20 @@ func main() {
     }
 
     if signRepo {
-        fmt.Println("Signing with gpg...")
-        exec.Command("gpg", "--yes", "--pinentry-mode", "loopback", "--digest-algo", "SHA256", "--clearsign", "-o",
-            filepath.Join(distributionPath, "InRelease"), releaseFilePath).Run()
+        if signingKeyPath == "" {
+            fmt.Fprintln(os.Stderr, "Error: -sign requires -signing-key")
+            os.Exit(1)
+        }
+        fmt.Println("Signing repository...")
+        entity, err := loadSigningEntity(signingKeyPath, signingKeyPassphraseFile)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "Error loading signing key: %v\n", err)
+            os.Exit(1)
+        }
+        if err := signRelease(entity, releaseFilePath, distributionPath); err != nil {
+            fmt.Fprintf(os.Stderr, "Error signing repository: %v\n", err)
+            os.Exit(1)
+        }
     }
 
     fmt.Println("Done!")
@@ -362,28 +470,6 @@ func filterDirs(root string) []string {
     return dirs
 }
 
-func hashFile(hashType, filename string) []byte {
-    file, err := os.Open(filename)
-    if err != nil {
-        return nil
-    }
-    defer file.Close()
-
-    var h hash.Hash
-    switch hashType {
-    case "md5":
-        h = md5.New()
-    case "sha1":
-        h = sha1.New()
-    case "sha256":
-        h = sha256.New()
-    case "sha512":
-        h = sha512.New()
-    }
-    io.Copy(h, file)
-    return h.Sum(nil)
-}
-
 func fileSize(filename string) int64 {
     fi, err := os.Stat(filename)
     if err != nil {
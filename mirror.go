@@ -0,0 +1,293 @@
+package main
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "net/http"
+    "os"
+    "path/filepath"
+    "regexp"
+    "strings"
+
+    "github.com/ulikunitz/xz"
+    "golang.org/x/crypto/openpgp"
+)
+
+var (
+    mirrorURL        string
+    mirrorSuite      string
+    mirrorComponent  string
+    mirrorArch       string
+    mirrorPackages   string
+    mirrorKeyring    string
+    mirrorResolveDeps bool
+)
+
+// mirrorLockEntry records exactly what was mirrored so a rebuild can be
+// reproduced: the same package/version/url/sha256 should always resolve to
+// the same bytes.
+type mirrorLockEntry struct {
+    Package string `json:"package"`
+    Version string `json:"version"`
+    URL     string `json:"url"`
+    SHA256  string `json:"sha256"`
+}
+
+type mirrorPackageStanza struct {
+    Name     string
+    Version  string
+    Filename string
+    SHA256   string
+    Depends  string
+}
+
+func fetchURL(url string) ([]byte, error) {
+    resp, err := http.Get(url)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+    }
+    return ioutil.ReadAll(resp.Body)
+}
+
+// verifyRelease checks releaseData against a detached signature fetched
+// from url+".gpg" using the armored public keys in keyringPath.
+func verifyRelease(url string, releaseData []byte, keyringPath string) error {
+    keyringFile, err := os.Open(keyringPath)
+    if err != nil {
+        return fmt.Errorf("opening mirror keyring: %w", err)
+    }
+    defer keyringFile.Close()
+
+    keyring, err := openpgp.ReadArmoredKeyRing(keyringFile)
+    if err != nil {
+        return fmt.Errorf("reading mirror keyring: %w", err)
+    }
+
+    sigData, err := fetchURL(url + ".gpg")
+    if err != nil {
+        return fmt.Errorf("fetching Release.gpg: %w", err)
+    }
+
+    _, err = openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(releaseData), bytes.NewReader(sigData))
+    if err != nil {
+        return fmt.Errorf("signature verification failed: %w", err)
+    }
+    return nil
+}
+
+// releaseHashedPath returns the sha256 listed in a Release file's SHA256:
+// section for relPath (e.g. "main/binary-aarch64/Packages.xz"), so the
+// downloaded Packages.xz can be checked before it is trusted and decoded.
+func releaseHashedPath(releaseData []byte, relPath string) string {
+    lines := strings.Split(string(releaseData), "\n")
+    inSHA256 := false
+    for _, line := range lines {
+        if strings.HasPrefix(line, "SHA256:") {
+            inSHA256 = true
+            continue
+        }
+        if inSHA256 {
+            if len(line) == 0 || line[0] != ' ' {
+                inSHA256 = false
+                continue
+            }
+            fields := strings.Fields(line)
+            if len(fields) == 3 && fields[2] == relPath {
+                return fields[0]
+            }
+        }
+    }
+    return ""
+}
+
+func parsePackagesFile(data []byte) map[string]mirrorPackageStanza {
+    stanzas := map[string]mirrorPackageStanza{}
+    for _, block := range strings.Split(string(data), "\n\n") {
+        if strings.TrimSpace(block) == "" {
+            continue
+        }
+        var s mirrorPackageStanza
+        if m := regexp.MustCompile(`(?m)^Package: (.*)$`).FindStringSubmatch(block); m != nil {
+            s.Name = strings.TrimSpace(m[1])
+        }
+        if m := regexp.MustCompile(`(?m)^Version: (.*)$`).FindStringSubmatch(block); m != nil {
+            s.Version = strings.TrimSpace(m[1])
+        }
+        if m := regexp.MustCompile(`(?m)^Filename: (.*)$`).FindStringSubmatch(block); m != nil {
+            s.Filename = strings.TrimSpace(m[1])
+        }
+        if m := regexp.MustCompile(`(?m)^SHA256: (.*)$`).FindStringSubmatch(block); m != nil {
+            s.SHA256 = strings.TrimSpace(m[1])
+        }
+        if m := regexp.MustCompile(`(?m)^Depends: (.*)$`).FindStringSubmatch(block); m != nil {
+            s.Depends = strings.TrimSpace(m[1])
+        }
+        if s.Name != "" {
+            stanzas[s.Name] = s
+        }
+    }
+    return stanzas
+}
+
+// dependsPackageNames extracts the bare package names referenced by a
+// Depends field, taking the first alternative of any "a | b" choice and
+// stripping version constraints like "(>= 1.2)".
+func dependsPackageNames(depends string) []string {
+    if depends == "" {
+        return nil
+    }
+    var names []string
+    for _, dep := range strings.Split(depends, ",") {
+        alt := strings.Split(dep, "|")[0]
+        alt = strings.TrimSpace(regexp.MustCompile(`\(.*\)`).ReplaceAllString(alt, ""))
+        if alt != "" {
+            names = append(names, alt)
+        }
+    }
+    return names
+}
+
+// resolvePackages starts from the requested package names and, if
+// mirrorResolveDeps is set, walks Depends fields to pull in the full
+// dependency closure available in stanzas.
+func resolvePackages(stanzas map[string]mirrorPackageStanza, requested []string) []mirrorPackageStanza {
+    seen := map[string]bool{}
+    var queue []string
+    queue = append(queue, requested...)
+    var resolved []mirrorPackageStanza
+
+    for len(queue) > 0 {
+        name := queue[0]
+        queue = queue[1:]
+        if seen[name] {
+            continue
+        }
+        seen[name] = true
+
+        stanza, ok := stanzas[name]
+        if !ok {
+            fmt.Fprintf(os.Stderr, "Warning: '%s' not found in upstream Packages, skipping\n", name)
+            continue
+        }
+        resolved = append(resolved, stanza)
+
+        if mirrorResolveDeps {
+            queue = append(queue, dependsPackageNames(stanza.Depends)...)
+        }
+    }
+    return resolved
+}
+
+// runMirror downloads the requested packages (and optionally their Depends
+// closure) from mirrorURL into a local staging area, verifying each
+// against the hashes listed in the upstream Packages file, and writes a
+// mirror-lock.json recording exactly what was fetched. It returns the
+// staged .deb paths, ready to be fed into addDeb like any other input file.
+func runMirror(outputPath string) ([]string, error) {
+    releaseURL := mirrorURL + "/dists/" + mirrorSuite + "/Release"
+    releaseData, err := fetchURL(releaseURL)
+    if err != nil {
+        return nil, fmt.Errorf("fetching Release: %w", err)
+    }
+
+    if mirrorKeyring != "" {
+        if err := verifyRelease(releaseURL, releaseData, mirrorKeyring); err != nil {
+            return nil, err
+        }
+    } else {
+        fmt.Fprintln(os.Stderr, "Warning: -mirror-keyring not set, upstream Release signature not verified")
+    }
+
+    packagesRelPath := filepath.Join(mirrorComponent, "binary-"+mirrorArch, "Packages.xz")
+    packagesURL := mirrorURL + "/dists/" + mirrorSuite + "/" + packagesRelPath
+    packagesXz, err := fetchURL(packagesURL)
+    if err != nil {
+        return nil, fmt.Errorf("fetching Packages.xz: %w", err)
+    }
+
+    if expected := releaseHashedPath(releaseData, packagesRelPath); expected != "" {
+        if got := sha256.Sum256(packagesXz); hex.EncodeToString(got[:]) != expected {
+            return nil, fmt.Errorf("Packages.xz sha256 mismatch: Release lists %s", expected)
+        }
+    } else {
+        fmt.Fprintf(os.Stderr, "Warning: Release has no SHA256 entry for %s, Packages.xz not verified\n", packagesRelPath)
+    }
+
+    xzReader, err := xz.NewReader(bytes.NewReader(packagesXz))
+    if err != nil {
+        return nil, fmt.Errorf("decompressing Packages.xz: %w", err)
+    }
+    packagesData, err := ioutil.ReadAll(xzReader)
+    if err != nil {
+        return nil, fmt.Errorf("decompressing Packages.xz: %w", err)
+    }
+
+    stanzas := parsePackagesFile(packagesData)
+
+    var requested []string
+    for _, name := range strings.Split(mirrorPackages, ",") {
+        name = strings.TrimSpace(name)
+        if name != "" {
+            requested = append(requested, name)
+        }
+    }
+    if len(requested) == 0 {
+        return nil, fmt.Errorf("-mirror-packages must list at least one package")
+    }
+
+    resolved := resolvePackages(stanzas, requested)
+
+    stagingDir := filepath.Join(outputPath, ".mirror-cache", mirrorComponent)
+    if err := os.MkdirAll(stagingDir, 0755); err != nil {
+        return nil, fmt.Errorf("creating mirror staging directory: %w", err)
+    }
+
+    var stagedPaths []string
+    var lockEntries []mirrorLockEntry
+
+    for _, stanza := range resolved {
+        debURL := mirrorURL + "/" + stanza.Filename
+        debData, err := fetchURL(debURL)
+        if err != nil {
+            return nil, fmt.Errorf("fetching '%s': %w", debURL, err)
+        }
+        if stanza.SHA256 != "" {
+            got := sha256.Sum256(debData)
+            if hex.EncodeToString(got[:]) != stanza.SHA256 {
+                return nil, fmt.Errorf("'%s' sha256 mismatch: Packages lists %s", debURL, stanza.SHA256)
+            }
+        }
+
+        stagedPath := filepath.Join(stagingDir, filepath.Base(stanza.Filename))
+        if err := ioutil.WriteFile(stagedPath, debData, 0644); err != nil {
+            return nil, fmt.Errorf("writing '%s': %w", stagedPath, err)
+        }
+
+        fmt.Println("Mirrored:", stanza.Name, stanza.Version)
+        stagedPaths = append(stagedPaths, stagedPath)
+        lockEntries = append(lockEntries, mirrorLockEntry{
+            Package: stanza.Name,
+            Version: stanza.Version,
+            URL:     debURL,
+            SHA256:  stanza.SHA256,
+        })
+    }
+
+    lockData, err := json.MarshalIndent(lockEntries, "", "  ")
+    if err != nil {
+        return nil, fmt.Errorf("encoding mirror lockfile: %w", err)
+    }
+    if err := ioutil.WriteFile(filepath.Join(outputPath, "mirror-lock.json"), lockData, 0644); err != nil {
+        return nil, fmt.Errorf("writing mirror lockfile: %w", err)
+    }
+
+    return stagedPaths, nil
+}
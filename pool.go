@@ -0,0 +1,95 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+)
+
+// poolDebPath returns where a .deb for component/pkgName/basename should live
+// under outputPath/pool, following the Debian pool layout: packages are
+// bucketed by poolPrefix(pkgName) to keep any one directory from growing
+// without bound, and the original filename (already name_version_arch.deb,
+// as produced by dpkg-deb) is kept as-is so it also works as the cache key.
+func poolDebPath(outputPath, component, pkgName, basename string) string {
+    return filepath.Join(outputPath, "pool", component, poolPrefix(pkgName), pkgName, basename)
+}
+
+// archFromDebFilename extracts the architecture from a standard
+// name_version_arch.deb filename. Returns "" if the filename doesn't
+// follow that convention.
+func archFromDebFilename(basename string) string {
+    name := strings.TrimSuffix(basename, ".deb")
+    parts := strings.Split(name, "_")
+    if len(parts) < 3 {
+        return ""
+    }
+    return parts[len(parts)-1]
+}
+
+// poolDebsForArch lists every .deb currently in component's pool directory
+// that was built for the given architecture.
+func poolDebsForArch(outputPath, component, arch string) []string {
+    var matches []string
+    for _, debPath := range glob(filepath.Join(outputPath, "pool", component, "*", "*", "*.deb")) {
+        if archFromDebFilename(filepath.Base(debPath)) == arch {
+            matches = append(matches, debPath)
+        }
+    }
+    return matches
+}
+
+// versionOfPoolDeb returns the Debian version of a pool .deb, preferring the
+// cached control file (authoritative and already parsed) and falling back
+// to the version embedded in the filename for debs the cache doesn't know
+// about yet.
+func versionOfPoolDeb(cache *repoCache, component, arch, debPath string) string {
+    if cached, ok := cache.get(cacheKey(component, arch, filepath.Base(debPath))); ok {
+        return getPackageVersion(cached.Control)
+    }
+    name := strings.TrimSuffix(filepath.Base(debPath), ".deb")
+    parts := strings.Split(name, "_")
+    if len(parts) >= 3 {
+        return parts[len(parts)-2]
+    }
+    return ""
+}
+
+// pruneOldVersions keeps, for every (component, package, arch) in the pool
+// of the components in COMPONENTS, only the keep newest versions by Debian version ordering, deleting
+// the rest from disk and from the cache. A keep of 0 or less disables
+// pruning entirely.
+func pruneOldVersions(cache *repoCache, keep int) {
+    if keep <= 0 {
+        return
+    }
+
+    for _, component := range COMPONENTS {
+        for _, pkgDir := range glob(filepath.Join(outputPath, "pool", component, "*", "*")) {
+            debsByArch := map[string][]string{}
+            for _, debPath := range glob(filepath.Join(pkgDir, "*.deb")) {
+                arch := archFromDebFilename(filepath.Base(debPath))
+                if arch == "" {
+                    continue
+                }
+                debsByArch[arch] = append(debsByArch[arch], debPath)
+            }
+
+            for arch, debPaths := range debsByArch {
+                if len(debPaths) <= keep {
+                    continue
+                }
+                sort.Slice(debPaths, func(i, j int) bool {
+                    return compareDebVersions(versionOfPoolDeb(cache, component, arch, debPaths[i]), versionOfPoolDeb(cache, component, arch, debPaths[j])) > 0
+                })
+                for _, stale := range debPaths[keep:] {
+                    fmt.Println("Pruning old version:", filepath.Base(stale))
+                    os.Remove(stale)
+                    cache.remove(cacheKey(component, arch, filepath.Base(stale)))
+                }
+            }
+        }
+    }
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "net/http"
+    "os"
+    "path/filepath"
+    "regexp"
+    "strings"
+    "sync"
+)
+
+// validComponentName matches the component names we're willing to create an
+// input directory for. It rejects "..", path separators and anything else
+// that could escape inputPath when joined in.
+var validComponentName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// rebuildMu serializes calls to buildRepo() triggered from HTTP handlers.
+// buildRepo mutates package-level state (COMPONENTS, encounteredArches) and
+// rewrites the on-disk cache/Release/pool files, none of which is safe for
+// concurrent upload requests to race on.
+var rebuildMu sync.Mutex
+
+// contentTypeFor returns the Content-Type apt expects for the repo files
+// we serve; http.FileServer's extension-based guessing gets most of these
+// wrong (or falls back to octet-stream) since Packages/Release/InRelease
+// have no extension at all.
+func contentTypeFor(name string) string {
+    switch {
+    case strings.HasSuffix(name, ".xz"):
+        return "application/x-xz"
+    case strings.HasSuffix(name, ".deb"):
+        return "application/vnd.debian.binary-package"
+    case strings.HasSuffix(name, ".gpg"):
+        return "application/pgp-signature"
+    case strings.HasSuffix(name, "Release") || strings.HasSuffix(name, "InRelease"):
+        return "text/plain; charset=utf-8"
+    case filepath.Base(name) == "Packages":
+        return "text/plain; charset=utf-8"
+    case strings.Contains(filepath.Base(name), "Contents-"):
+        return "text/plain; charset=utf-8"
+    default:
+        return ""
+    }
+}
+
+// serveRepo serves outputPath over HTTP at serveAddr, with correct
+// Content-Type headers for the apt metadata and package files it contains,
+// plus an upload endpoint (gated by -serve-upload-secret) that accepts a
+// .deb, drops it into the input pool and re-indexes the repo.
+func serveRepo() {
+    fileServer := http.FileServer(http.Dir(outputPath))
+
+    mux := http.NewServeMux()
+    mux.HandleFunc("/upload", handleUpload)
+    mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+        if ct := contentTypeFor(r.URL.Path); ct != "" {
+            w.Header().Set("Content-Type", ct)
+        }
+        fileServer.ServeHTTP(w, r)
+    })
+
+    fmt.Println("Serving", outputPath, "on", serveAddr)
+    if err := http.ListenAndServe(serveAddr, mux); err != nil {
+        fmt.Fprintf(os.Stderr, "Error serving repo: %v\n", err)
+        os.Exit(1)
+    }
+}
+
+// handleUpload accepts a .deb via POST or PUT, gated by a shared secret
+// sent as the X-Repo-Secret header, drops it into the input directory of the
+// component named by ?component= (the default component when omitted) and
+// triggers a full re-index.
+func handleUpload(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost && r.Method != http.MethodPut {
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    if serveUploadSecret == "" {
+        http.Error(w, "uploads are disabled (no -serve-upload-secret configured)", http.StatusForbidden)
+        return
+    }
+    if r.Header.Get("X-Repo-Secret") != serveUploadSecret {
+        http.Error(w, "invalid or missing X-Repo-Secret", http.StatusUnauthorized)
+        return
+    }
+
+    filename := filepath.Base(r.URL.Query().Get("filename"))
+    if filename == "" || !strings.HasSuffix(filename, ".deb") {
+        http.Error(w, "?filename=<name>.deb is required", http.StatusBadRequest)
+        return
+    }
+
+    component := r.URL.Query().Get("component")
+    if component == "" {
+        component = defaultComponent
+    }
+    if !validComponentName.MatchString(component) {
+        http.Error(w, "component must match "+validComponentName.String(), http.StatusBadRequest)
+        return
+    }
+
+    destDir := filepath.Join(inputPath, component)
+    if err := os.MkdirAll(destDir, 0755); err != nil {
+        http.Error(w, "could not create component directory", http.StatusInternalServerError)
+        return
+    }
+
+    destPath := filepath.Join(destDir, filename)
+    destFile, err := os.Create(destPath)
+    if err != nil {
+        http.Error(w, "could not save upload", http.StatusInternalServerError)
+        return
+    }
+    n, err := io.Copy(destFile, r.Body)
+    destFile.Close()
+    if err != nil || n == 0 {
+        os.Remove(destPath)
+        http.Error(w, "could not save upload", http.StatusInternalServerError)
+        return
+    }
+
+    fmt.Println("Received upload:", filename, "-> component", component)
+    rebuildMu.Lock()
+    buildRepo()
+    rebuildMu.Unlock()
+
+    w.WriteHeader(http.StatusCreated)
+    fmt.Fprintln(w, "uploaded and re-indexed:", filename)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+    "fmt"
+    "io/ioutil"
+    "os"
+    "strings"
+
+    "golang.org/x/crypto/openpgp"
+    "golang.org/x/crypto/openpgp/armor"
+    "golang.org/x/crypto/openpgp/clearsign"
+)
+
+// loadSigningEntity reads an ASCII-armored secret key from keyPath and, if
+// it is passphrase-protected, decrypts it with the contents of
+// passphraseFilePath (trailing newline trimmed).
+func loadSigningEntity(keyPath, passphraseFilePath string) (*openpgp.Entity, error) {
+    keyFile, err := os.Open(keyPath)
+    if err != nil {
+        return nil, fmt.Errorf("opening signing key: %w", err)
+    }
+    defer keyFile.Close()
+
+    entityList, err := openpgp.ReadArmoredKeyRing(keyFile)
+    if err != nil {
+        return nil, fmt.Errorf("reading signing key: %w", err)
+    }
+    if len(entityList) == 0 {
+        return nil, fmt.Errorf("no keys found in '%s'", keyPath)
+    }
+    entity := entityList[0]
+
+    if entity.PrivateKey != nil && entity.PrivateKey.Encrypted {
+        if passphraseFilePath == "" {
+            return nil, fmt.Errorf("signing key '%s' is passphrase-protected but -signing-key-passphrase-file was not given", keyPath)
+        }
+        passphrase, err := ioutil.ReadFile(passphraseFilePath)
+        if err != nil {
+            return nil, fmt.Errorf("reading signing key passphrase: %w", err)
+        }
+        passphrase = []byte(strings.TrimRight(string(passphrase), "\r\n"))
+
+        if err := entity.PrivateKey.Decrypt(passphrase); err != nil {
+            return nil, fmt.Errorf("decrypting signing key: %w", err)
+        }
+        for _, subkey := range entity.Subkeys {
+            if subkey.PrivateKey != nil && subkey.PrivateKey.Encrypted {
+                if err := subkey.PrivateKey.Decrypt(passphrase); err != nil {
+                    return nil, fmt.Errorf("decrypting signing subkey: %w", err)
+                }
+            }
+        }
+    }
+
+    return entity, nil
+}
+
+// signRelease produces, alongside the given Release file, a clear-signed
+// InRelease and a detached ascii-armored Release.gpg, the two forms apt
+// accepts for a signed repository. It also exports entity's public key to
+// <outputPath>/<distribution>.gpg so users can `apt-key add` it.
+func signRelease(entity *openpgp.Entity, releaseFilePath, distributionPath string) error {
+    releaseContents, err := ioutil.ReadFile(releaseFilePath)
+    if err != nil {
+        return fmt.Errorf("reading Release file: %w", err)
+    }
+
+    inReleaseFile, err := os.Create(distributionPath + "/InRelease")
+    if err != nil {
+        return fmt.Errorf("creating InRelease: %w", err)
+    }
+    defer inReleaseFile.Close()
+    clearsignWriter, err := clearsign.Encode(inReleaseFile, entity.PrivateKey, nil)
+    if err != nil {
+        return fmt.Errorf("clearsigning Release: %w", err)
+    }
+    if _, err := clearsignWriter.Write(releaseContents); err != nil {
+        return fmt.Errorf("clearsigning Release: %w", err)
+    }
+    if err := clearsignWriter.Close(); err != nil {
+        return fmt.Errorf("clearsigning Release: %w", err)
+    }
+
+    releaseGpgFile, err := os.Create(distributionPath + "/Release.gpg")
+    if err != nil {
+        return fmt.Errorf("creating Release.gpg: %w", err)
+    }
+    defer releaseGpgFile.Close()
+    if err := openpgp.ArmoredDetachSign(releaseGpgFile, entity, strings.NewReader(string(releaseContents)), nil); err != nil {
+        return fmt.Errorf("detached-signing Release: %w", err)
+    }
+
+    pubKeyPath := outputPath + "/" + distribution + ".gpg"
+    pubKeyFile, err := os.Create(pubKeyPath)
+    if err != nil {
+        return fmt.Errorf("creating public key file: %w", err)
+    }
+    defer pubKeyFile.Close()
+    armorWriter, err := armor.Encode(pubKeyFile, openpgp.PublicKeyType, nil)
+    if err != nil {
+        return fmt.Errorf("armoring public key: %w", err)
+    }
+    if err := entity.Serialize(armorWriter); err != nil {
+        return fmt.Errorf("serializing public key: %w", err)
+    }
+    return armorWriter.Close()
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+    "regexp"
+    "strings"
+)
+
+// poolPrefix mirrors dpkg-scanpackages' pool directory convention: packages
+// are bucketed by their first letter, except "lib*" packages which are
+// bucketed by their first four characters (libc, libx, ...) to keep the
+// "lib" directory from becoming a dumping ground.
+func poolPrefix(pkgName string) string {
+    if strings.HasPrefix(pkgName, "lib") && len(pkgName) > 3 {
+        return pkgName[:4]
+    }
+    if len(pkgName) == 0 {
+        return "misc"
+    }
+    return pkgName[:1]
+}
+
+func getPackageVersion(controlFile string) string {
+    m := regexp.MustCompile(`Version: (.*)`).FindStringSubmatch(controlFile)
+    if m == nil {
+        return ""
+    }
+    return strings.TrimSpace(m[1])
+}
+
+// debVersion is a parsed Debian package version: [epoch:]upstream[-revision].
+type debVersion struct {
+    epoch      string
+    upstream   string
+    revision   string
+}
+
+func parseDebVersion(v string) debVersion {
+    dv := debVersion{epoch: "0"}
+
+    if idx := strings.Index(v, ":"); idx != -1 {
+        dv.epoch = v[:idx]
+        v = v[idx+1:]
+    }
+
+    if idx := strings.LastIndex(v, "-"); idx != -1 {
+        dv.upstream = v[:idx]
+        dv.revision = v[idx+1:]
+    } else {
+        dv.upstream = v
+        dv.revision = "0"
+    }
+
+    return dv
+}
+
+// compareDebVersions implements the ordering rules from Debian Policy
+// §5.6.12: compare epoch, then upstream version, then revision, each using
+// the same alternating-alpha/numeric algorithm where "~" sorts before
+// everything, including the empty string. Returns <0, 0 or >0 like
+// strings.Compare.
+func compareDebVersions(a, b string) int {
+    da, db := parseDebVersion(a), parseDebVersion(b)
+
+    if c := compareVersionPart(da.epoch, db.epoch); c != 0 {
+        return c
+    }
+    if c := compareVersionPart(da.upstream, db.upstream); c != 0 {
+        return c
+    }
+    return compareVersionPart(da.revision, db.revision)
+}
+
+func compareVersionPart(a, b string) int {
+    for len(a) > 0 || len(b) > 0 {
+        // Compare runs of non-digits lexically, with the special Debian
+        // "~" rule: '~' sorts before anything, even the end of string.
+        var aAlpha, bAlpha string
+        aAlpha, a = takeNonDigits(a)
+        bAlpha, b = takeNonDigits(b)
+        if c := compareAlpha(aAlpha, bAlpha); c != 0 {
+            return c
+        }
+
+        var aNum, bNum string
+        aNum, a = takeDigits(a)
+        bNum, b = takeDigits(b)
+        if c := compareNumeric(aNum, bNum); c != 0 {
+            return c
+        }
+    }
+    return 0
+}
+
+func takeNonDigits(s string) (string, string) {
+    i := 0
+    for i < len(s) && (s[i] < '0' || s[i] > '9') {
+        i++
+    }
+    return s[:i], s[i:]
+}
+
+func takeDigits(s string) (string, string) {
+    i := 0
+    for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+        i++
+    }
+    return s[:i], s[i:]
+}
+
+func compareAlpha(a, b string) int {
+    i := 0
+    for i < len(a) || i < len(b) {
+        var ca, cb int
+        if i < len(a) {
+            ca = charOrder(a[i])
+        }
+        if i < len(b) {
+            cb = charOrder(b[i])
+        }
+        if ca != cb {
+            if ca < cb {
+                return -1
+            }
+            return 1
+        }
+        i++
+    }
+    return 0
+}
+
+// charOrder ranks '~' below everything (including the end of string, which
+// is represented by a zero-valued byte) and letters below non-letters, as
+// required by Debian Policy's version comparison algorithm.
+func charOrder(c byte) int {
+    if c == '~' {
+        return -1
+    }
+    if c == 0 {
+        return 0
+    }
+    if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' {
+        return int(c)
+    }
+    return int(c) + 256
+}
+
+func compareNumeric(a, b string) int {
+    a = strings.TrimLeft(a, "0")
+    b = strings.TrimLeft(b, "0")
+    if len(a) != len(b) {
+        if len(a) < len(b) {
+            return -1
+        }
+        return 1
+    }
+    if a < b {
+        return -1
+    }
+    if a > b {
+        return 1
+    }
+    return 0
+}
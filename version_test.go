@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestCompareDebVersions(t *testing.T) {
+    cases := []struct {
+        a, b string
+        want int
+    }{
+        {"1.0", "1.0", 0},
+        {"1.0", "1.1", -1},
+        {"1.1", "1.0", 1},
+        {"1:1.0", "2.0", 1},
+        {"1:1.0", "1:1.0", 0},
+        {"0:1.0", "1.0", 0},
+        {"1.0-1", "1.0-2", -1},
+        {"1.0-2", "1.0-1", 1},
+        {"1.0~rc1", "1.0", -1},
+        {"1.0", "1.0~rc1", 1},
+        {"1.0~rc1", "1.0~rc2", -1},
+        {"1.0~~", "1.0~~rc1", -1},
+        {"1.0a", "1.0b", -1},
+        {"1.0a1", "1.0a10", -1},
+        {"1.0", "1.0a", -1},
+        {"1.2.3", "1.10.0", -1},
+        {"1.0-1.1", "1.0-1", 1},
+    }
+
+    for _, c := range cases {
+        if got := compareDebVersions(c.a, c.b); sign(got) != sign(c.want) {
+            t.Errorf("compareDebVersions(%q, %q) = %d, want sign %d", c.a, c.b, got, c.want)
+        }
+    }
+}
+
+func sign(n int) int {
+    switch {
+    case n < 0:
+        return -1
+    case n > 0:
+        return 1
+    default:
+        return 0
+    }
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+    "crypto/md5"
+    "crypto/sha1"
+    "crypto/sha256"
+    "crypto/sha512"
+    "fmt"
+    "io"
+    "os"
+    "runtime"
+    "sync"
+)
+
+// jobs is the worker pool size for hashing and xz compression, set via
+// -jobs. 0 (the default) means runtime.NumCPU().
+var jobs int
+
+func numWorkers() int {
+    if jobs > 0 {
+        return jobs
+    }
+    return runtime.NumCPU()
+}
+
+// parallelForEach runs fn over items on a pool of numWorkers() goroutines,
+// blocking until every item has been processed.
+func parallelForEach(items []string, fn func(string)) {
+    sem := make(chan struct{}, numWorkers())
+    var wg sync.WaitGroup
+
+    for _, item := range items {
+        wg.Add(1)
+        sem <- struct{}{}
+        go func(it string) {
+            defer wg.Done()
+            defer func() { <-sem }()
+            fn(it)
+        }(item)
+    }
+
+    wg.Wait()
+}
+
+// fileHashes holds the md5/sha1/sha256/sha512 digests of a file, as computed
+// by hashAllFile.
+type fileHashes struct {
+    MD5    string
+    SHA1   string
+    SHA256 string
+    SHA512 string
+}
+
+// hashAllFile computes md5/sha1/sha256/sha512 of filename in a single read
+// pass, fanning the bytes out to all four hashers via io.MultiWriter
+// instead of opening and re-reading the file once per algorithm.
+func hashAllFile(filename string) fileHashes {
+    file, err := os.Open(filename)
+    if err != nil {
+        return fileHashes{}
+    }
+    defer file.Close()
+
+    md5h, sha1h, sha256h, sha512h := md5.New(), sha1.New(), sha256.New(), sha512.New()
+    io.Copy(io.MultiWriter(md5h, sha1h, sha256h, sha512h), file)
+
+    return fileHashes{
+        MD5:    fmt.Sprintf("%x", md5h.Sum(nil)),
+        SHA1:   fmt.Sprintf("%x", sha1h.Sum(nil)),
+        SHA256: fmt.Sprintf("%x", sha256h.Sum(nil)),
+        SHA512: fmt.Sprintf("%x", sha512h.Sum(nil)),
+    }
+}
+
+func (h fileHashes) forType(hashType string) string {
+    switch hashType {
+    case "md5":
+        return h.MD5
+    case "sha1":
+        return h.SHA1
+    case "sha256":
+        return h.SHA256
+    case "sha512":
+        return h.SHA512
+    }
+    return ""
+}